@@ -0,0 +1,108 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Persister durably stores the term, vote, and log a peer must remember
+// across restarts -- Raft requires these be on disk before the peer
+// responds to any RPC.
+type Persister interface {
+	SaveState(term int, votedFor int, log []Entry) error
+	LoadState() (term int, votedFor int, log []Entry, err error)
+}
+
+type persistedState struct {
+	Term     int
+	VotedFor int
+	Log      []Entry
+}
+
+// FilePersister is the default Persister: it writes state to a single
+// file, via a temp-file-plus-rename so a crash mid-write can't leave a
+// corrupt file behind.
+type FilePersister struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFilePersister returns a Persister backed by the file at path.
+func NewFilePersister(path string) *FilePersister {
+	return &FilePersister{path: path}
+}
+
+func (p *FilePersister) SaveState(term int, votedFor int, log []Entry) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(persistedState{term, votedFor, log}); err != nil {
+		return err
+	}
+
+	tmp := p.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	return os.Rename(tmp, p.path)
+}
+
+func (p *FilePersister) LoadState() (term int, votedFor int, log []Entry, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return 0, -1, nil, err
+	}
+
+	var st persistedState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+		return 0, -1, nil, err
+	}
+	return st.Term, st.VotedFor, st.Log, nil
+}
+
+// MemoryPersister is an in-memory Persister, useful for tests that don't
+// need state to survive a process restart.
+type MemoryPersister struct {
+	mu    sync.Mutex
+	state persistedState
+	saved bool
+}
+
+// NewMemoryPersister returns a Persister that keeps state in memory only.
+func NewMemoryPersister() *MemoryPersister {
+	return &MemoryPersister{state: persistedState{VotedFor: -1}}
+}
+
+func (p *MemoryPersister) SaveState(term int, votedFor int, log []Entry) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = persistedState{term, votedFor, log}
+	p.saved = true
+	return nil
+}
+
+func (p *MemoryPersister) LoadState() (term int, votedFor int, log []Entry, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.saved {
+		return 0, -1, nil, os.ErrNotExist
+	}
+	return p.state.Term, p.state.VotedFor, p.state.Log, nil
+}
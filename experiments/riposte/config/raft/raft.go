@@ -0,0 +1,532 @@
+// Package raft implements the subset of the Raft consensus protocol that
+// the DB pipeline needs: dynamic leader election and replication of the
+// pipeline's PREPARE/AUDIT/COMMIT/MERGE transitions, so that a new leader
+// elected mid-batch can tell which in-flight uuids need to be resumed.
+//
+// It follows the description in "In Search of an Understandable Consensus
+// Algorithm" (Ongaro & Ousterhout): followers become candidates on
+// election timeout, candidates request votes from their peers, and the
+// leader replicates log entries to followers, committing an entry once it
+// is stored on a majority.
+package raft
+
+import (
+	"log"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// EntryKind identifies which pipeline transition a log Entry carries.
+type EntryKind int
+
+const (
+	EntryUploadBatch EntryKind = iota
+	EntryAuditResult
+	EntryCommit
+	EntryBeginMerge
+)
+
+// Entry is a single replicated log entry -- one pipeline transition.
+//
+// Payload carries whatever data downstream pipeline stages need to resume
+// after a leader change, opaquely gob-encoded by the db package (the raft
+// package has no business knowing the pipeline's wire types). For an
+// EntryAuditResult, Payload is the encoded audit-query ciphertexts
+// computed at the end of the PREPARE phase -- without them a resumed
+// AUDIT has nothing to send to the Auditor.
+type Entry struct {
+	Term    int
+	Index   int
+	Kind    EntryKind
+	Uuid    int64
+	Okays   []bool
+	Payload []byte
+}
+
+type peerState int
+
+const (
+	Follower peerState = iota
+	Candidate
+	Leader
+)
+
+const (
+	heartbeatInterval  = 50 * time.Millisecond
+	electionTimeoutMin = 150 * time.Millisecond
+	electionTimeoutMax = 300 * time.Millisecond
+)
+
+// ApplyMsg is delivered on the Raft's apply channel once an Entry has been
+// committed to a majority of the cluster.
+type ApplyMsg struct {
+	Entry Entry
+}
+
+// Raft is one peer of the consensus group backing the DB pipeline.
+type Raft struct {
+	mu sync.Mutex
+
+	me        int
+	peerAddrs []string
+	peers     []*rpc.Client
+	persister Persister
+	applyCh   chan ApplyMsg
+
+	currentTerm int
+	votedFor    int
+	log         []Entry
+
+	state       peerState
+	leaderId    int
+	commitIndex int
+	lastApplied int
+
+	nextIndex  []int
+	matchIndex []int
+
+	resetElectionTimer chan struct{}
+	stopCh             chan struct{}
+	stopOnce           sync.Once
+
+	rand *rand.Rand
+}
+
+// NewRaft creates a Raft peer for server index `me` among `peerAddrs`,
+// replaying any persisted state, and starts its background goroutines.
+// Committed entries are delivered on applyCh.
+func NewRaft(me int, peerAddrs []string, persister Persister, applyCh chan ApplyMsg) *Raft {
+	r := &Raft{
+		me:                 me,
+		peerAddrs:          peerAddrs,
+		peers:              make([]*rpc.Client, len(peerAddrs)),
+		persister:          persister,
+		applyCh:            applyCh,
+		votedFor:           -1,
+		leaderId:           -1,
+		state:              Follower,
+		resetElectionTimer: make(chan struct{}, 1),
+		stopCh:             make(chan struct{}),
+		commitIndex:        -1,
+	}
+	// Each peer needs its own, distinctly-seeded source: the global
+	// math/rand source is only auto-seeded on Go 1.20+, and even then
+	// every peer in this process would otherwise share it, which is
+	// exactly the split-vote-on-startup scenario randomized election
+	// timeouts exist to avoid.
+	r.rand = rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(me)))
+
+	if term, votedFor, log, err := persister.LoadState(); err == nil {
+		r.currentTerm = term
+		r.votedFor = votedFor
+		r.log = log
+	}
+
+	go r.electionTimerLoop()
+	return r
+}
+
+// Stop tears down the peer's background goroutines. It is idempotent --
+// a caller that isn't sure whether Stop has already run (e.g. Shutdown
+// retried after a timed-out attempt) may call it again safely.
+func (r *Raft) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+	})
+}
+
+// IsLeader reports whether this peer currently believes it is the leader.
+func (r *Raft) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state == Leader
+}
+
+// LeaderAddr returns the RPC address of the peer this node last heard was
+// leader, or "" if it doesn't know.
+func (r *Raft) LeaderAddr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.leaderId < 0 {
+		return ""
+	}
+	return r.peerAddrs[r.leaderId]
+}
+
+// persistLocked saves the current term, vote, and log, logging (rather
+// than silently dropping) a failure. Raft's durability guarantee -- that
+// a peer never forgets a vote or a log entry it has already acknowledged
+// -- depends on this succeeding; callers cannot do much more than a
+// caller of fsync ever can, but a disk-full or permission error must at
+// least be visible instead of swallowed. Caller must hold r.mu.
+func (r *Raft) persistLocked() {
+	if err := r.persister.SaveState(r.currentTerm, r.votedFor, r.log); err != nil {
+		log.Printf("raft: peer %d failed to persist state: %v", r.me, err)
+	}
+}
+
+// Propose appends entry to the leader's log and begins replicating it.
+// It returns the index the entry was given, the term, and whether this
+// peer is actually the leader (if not, index/term are meaningless and the
+// caller should find the leader via LeaderAddr).
+func (r *Raft) Propose(entry Entry) (index int, term int, isLeader bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state != Leader {
+		return 0, 0, false
+	}
+
+	entry.Term = r.currentTerm
+	entry.Index = len(r.log)
+	r.log = append(r.log, entry)
+	r.persistLocked()
+
+	go r.replicateToAll()
+
+	return entry.Index, entry.Term, true
+}
+
+// PendingUuids returns the uuid of every PREPARE entry committed to the
+// log for which no matching COMMIT entry has yet been committed. A newly
+// elected leader uses this to resume submitAudits/submitCommits for any
+// uuid that was left mid-pipeline by its predecessor.
+func (r *Raft) PendingUuids() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	committed := map[int64]bool{}
+	done := map[int64]bool{}
+	var order []int64
+	for i := 0; i <= r.commitIndex && i < len(r.log); i++ {
+		e := r.log[i]
+		switch e.Kind {
+		case EntryUploadBatch:
+			if !committed[e.Uuid] {
+				order = append(order, e.Uuid)
+			}
+			committed[e.Uuid] = true
+		case EntryCommit:
+			done[e.Uuid] = true
+		}
+	}
+
+	pending := make([]int64, 0, len(order))
+	for _, uuid := range order {
+		if !done[uuid] {
+			pending = append(pending, uuid)
+		}
+	}
+	return pending
+}
+
+// AuditPayload returns the Payload of the most recently committed
+// EntryAuditResult entry for uuid, or nil if none has been committed --
+// e.g. because the leader that owned uuid crashed before the PREPARE
+// round's replies were gathered and logged.
+func (r *Raft) AuditPayload(uuid int64) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var payload []byte
+	for i := 0; i <= r.commitIndex && i < len(r.log); i++ {
+		e := r.log[i]
+		if e.Kind == EntryAuditResult && e.Uuid == uuid {
+			payload = e.Payload
+		}
+	}
+	return payload
+}
+
+func (r *Raft) randomElectionTimeout() time.Duration {
+	span := electionTimeoutMax - electionTimeoutMin
+	return electionTimeoutMin + time.Duration(r.rand.Int63n(int64(span)))
+}
+
+func (r *Raft) electionTimerLoop() {
+	timer := time.NewTimer(r.randomElectionTimeout())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-r.resetElectionTimer:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(r.randomElectionTimeout())
+		case <-timer.C:
+			r.mu.Lock()
+			amLeader := r.state == Leader
+			r.mu.Unlock()
+			if !amLeader {
+				r.startElection()
+			}
+			timer.Reset(r.randomElectionTimeout())
+		}
+	}
+}
+
+func (r *Raft) kickElectionTimer() {
+	select {
+	case r.resetElectionTimer <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) startElection() {
+	r.mu.Lock()
+	r.state = Candidate
+	r.currentTerm++
+	r.votedFor = r.me
+	term := r.currentTerm
+	r.persistLocked()
+	args := RequestVoteArgs{
+		Term:         term,
+		CandidateId:  r.me,
+		LastLogIndex: len(r.log) - 1,
+		LastLogTerm:  lastTerm(r.log),
+	}
+	r.mu.Unlock()
+
+	log.Printf("raft: peer %d starting election for term %d", r.me, term)
+
+	votes := 1
+	var votesMu sync.Mutex
+	done := make(chan struct{})
+
+	for i := range r.peerAddrs {
+		if i == r.me {
+			continue
+		}
+		go func(peer int) {
+			var reply RequestVoteReply
+			if err := r.call(peer, "Raft.RequestVote", &args, &reply); err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			if reply.Term > r.currentTerm {
+				r.becomeFollower(reply.Term)
+				r.mu.Unlock()
+				return
+			}
+			r.mu.Unlock()
+
+			if reply.VoteGranted {
+				votesMu.Lock()
+				votes++
+				v := votes
+				votesMu.Unlock()
+				if v*2 > len(r.peerAddrs) {
+					select {
+					case done <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}(i)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(electionTimeoutMax):
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	votesMu.Lock()
+	won := votes*2 > len(r.peerAddrs)
+	votesMu.Unlock()
+
+	if r.state == Candidate && r.currentTerm == term && won {
+		r.becomeLeaderLocked()
+	}
+}
+
+func (r *Raft) becomeLeaderLocked() {
+	log.Printf("raft: peer %d became leader for term %d", r.me, r.currentTerm)
+	r.state = Leader
+	r.leaderId = r.me
+	r.nextIndex = make([]int, len(r.peerAddrs))
+	r.matchIndex = make([]int, len(r.peerAddrs))
+	for i := range r.nextIndex {
+		r.nextIndex[i] = len(r.log)
+		// -1, not the zero value: index 0 is a real, matchable log index,
+		// so a freshly zeroed matchIndex would be indistinguishable from
+		// "peer has index 0" and block replicateTo's new monotonic guard
+		// from ever recording that peer's first match.
+		r.matchIndex[i] = -1
+	}
+	go r.heartbeatLoop(r.currentTerm)
+}
+
+func (r *Raft) becomeFollower(term int) {
+	r.state = Follower
+	r.currentTerm = term
+	r.votedFor = -1
+	r.persistLocked()
+}
+
+func (r *Raft) heartbeatLoop(term int) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			stillLeader := r.state == Leader && r.currentTerm == term
+			r.mu.Unlock()
+			if !stillLeader {
+				return
+			}
+			r.replicateToAll()
+		}
+	}
+}
+
+func (r *Raft) replicateToAll() {
+	for i := range r.peerAddrs {
+		if i == r.me {
+			continue
+		}
+		go r.replicateTo(i)
+	}
+}
+
+func (r *Raft) replicateTo(peer int) {
+	r.mu.Lock()
+	if r.state != Leader {
+		r.mu.Unlock()
+		return
+	}
+	next := r.nextIndex[peer]
+	if next < 0 {
+		next = 0
+	}
+	prevIndex := next - 1
+	prevTerm := -1
+	if prevIndex >= 0 && prevIndex < len(r.log) {
+		prevTerm = r.log[prevIndex].Term
+	}
+	var entries []Entry
+	if next < len(r.log) {
+		entries = append(entries, r.log[next:]...)
+	}
+	args := AppendEntriesArgs{
+		Term:         r.currentTerm,
+		LeaderId:     r.me,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  prevTerm,
+		Entries:      entries,
+		LeaderCommit: r.commitIndex,
+	}
+	term := r.currentTerm
+	r.mu.Unlock()
+
+	var reply AppendEntriesReply
+	if err := r.call(peer, "Raft.AppendEntries", &args, &reply); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+
+	if reply.Term > r.currentTerm {
+		r.becomeFollower(reply.Term)
+		r.mu.Unlock()
+		return
+	}
+	if r.state != Leader || r.currentTerm != term {
+		r.mu.Unlock()
+		return
+	}
+
+	var newlyCommitted []Entry
+	if reply.Success {
+		// heartbeatLoop's ticker and a Propose-triggered replicateToAll can
+		// both have a replicateTo(peer) in flight at once; if the newer
+		// call's reply lands first, an older reply arriving after it must
+		// not walk matchIndex/nextIndex backward.
+		if matched := prevIndex + len(entries); matched > r.matchIndex[peer] {
+			r.matchIndex[peer] = matched
+			r.nextIndex[peer] = matched + 1
+			newlyCommitted = r.maybeAdvanceCommitLocked()
+		}
+	} else if r.nextIndex[peer] > 0 {
+		r.nextIndex[peer]--
+	}
+	r.mu.Unlock()
+
+	// Deliver outside the lock: applyCh is a bounded channel drained by
+	// its consumer, and a slow consumer must not be
+	// able to freeze r.mu -- that would stop this peer from servicing
+	// RequestVote/AppendEntries at all, i.e. exactly the cluster-wide
+	// stall Raft is supposed to prevent.
+	r.deliver(newlyCommitted)
+}
+
+// maybeAdvanceCommitLocked advances commitIndex to the highest index
+// replicated to a majority of peers and returns the entries that just
+// became committed, for the caller to deliver via deliver() once it has
+// released r.mu. Caller must hold r.mu.
+func (r *Raft) maybeAdvanceCommitLocked() []Entry {
+	for n := len(r.log) - 1; n > r.commitIndex; n-- {
+		if r.log[n].Term != r.currentTerm {
+			continue
+		}
+		count := 1
+		for i := range r.peerAddrs {
+			if i != r.me && r.matchIndex[i] >= n {
+				count++
+			}
+		}
+		if count*2 > len(r.peerAddrs) {
+			return r.commitThroughLocked(n)
+		}
+	}
+	return nil
+}
+
+// commitThroughLocked advances r.commitIndex to commitIndex and returns
+// the entries that just became committed, in log order. Caller must hold
+// r.mu; the caller is responsible for calling deliver() on the result
+// after releasing the lock.
+func (r *Raft) commitThroughLocked(commitIndex int) []Entry {
+	var entries []Entry
+	for r.commitIndex < commitIndex {
+		r.commitIndex++
+		entries = append(entries, r.log[r.commitIndex])
+	}
+	return entries
+}
+
+// deliver sends newly committed entries to applyCh, in order. It must be
+// called without r.mu held, since applyCh can block on a slow consumer.
+func (r *Raft) deliver(entries []Entry) {
+	for _, e := range entries {
+		r.applyCh <- ApplyMsg{Entry: e}
+	}
+}
+
+func lastTerm(log []Entry) int {
+	if len(log) == 0 {
+		return -1
+	}
+	return log[len(log)-1].Term
+}
+
+// logUpToDateLocked reports whether a candidate's log (lastTerm, lastIndex) is
+// at least as up to date as ours, per the Raft election restriction.
+func (r *Raft) logUpToDateLocked(lastLogTerm, lastLogIndex int) bool {
+	myLastTerm := lastTerm(r.log)
+	if lastLogTerm != myLastTerm {
+		return lastLogTerm > myLastTerm
+	}
+	return lastLogIndex >= len(r.log)-1
+}
@@ -0,0 +1,175 @@
+package raft
+
+import (
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPeer is one Raft peer wired up over a real loopback TCP listener, so
+// RequestVote/AppendEntries exercise the actual net/rpc path rather than
+// calling Raft methods directly in-process.
+type testPeer struct {
+	raft     *Raft
+	listener net.Listener
+	applyCh  chan ApplyMsg
+
+	mu      sync.Mutex
+	applied []Entry
+}
+
+// startTestCluster brings up n peers, each with its own listener, and
+// returns them once their addresses are known to each other.
+func startTestCluster(t *testing.T, n int) []*testPeer {
+	t.Helper()
+
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		listeners[i] = ln
+		addrs[i] = ln.Addr().String()
+	}
+
+	peers := make([]*testPeer, n)
+	for i := 0; i < n; i++ {
+		p := &testPeer{listener: listeners[i], applyCh: make(chan ApplyMsg, 16)}
+		p.raft = NewRaft(i, addrs, NewMemoryPersister(), p.applyCh)
+
+		server := rpc.NewServer()
+		if err := server.RegisterName("Raft", p.raft); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle(rpc.DefaultRPCPath, server)
+		go http.Serve(p.listener, mux)
+
+		go func(p *testPeer) {
+			for msg := range p.applyCh {
+				p.mu.Lock()
+				p.applied = append(p.applied, msg.Entry)
+				p.mu.Unlock()
+			}
+		}(p)
+
+		peers[i] = p
+	}
+
+	t.Cleanup(func() {
+		for _, p := range peers {
+			p.raft.Stop()
+			p.listener.Close()
+		}
+	})
+
+	return peers
+}
+
+// waitForLeader polls until one of peers believes it is leader (or t.Fatal
+// if none does within the timeout), returning the index of the first such
+// peer found. It does not check that no other peer also believes it.
+func waitForLeader(t *testing.T, peers []*testPeer, timeout time.Duration) int {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for i, p := range peers {
+			if p.raft.IsLeader() {
+				return i
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no leader elected within %v", timeout)
+	return -1
+}
+
+// appliedUuids returns the uuids of EntryUploadBatch entries p has applied,
+// in the order it applied them.
+func (p *testPeer) appliedUuids() []int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var uuids []int64
+	for _, e := range p.applied {
+		if e.Kind == EntryUploadBatch {
+			uuids = append(uuids, e.Uuid)
+		}
+	}
+	return uuids
+}
+
+func waitForUuid(t *testing.T, p *testPeer, uuid int64, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, u := range p.appliedUuids() {
+			if u == uuid {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("peer never applied uuid %d within %v", uuid, timeout)
+}
+
+// TestLeaderFailoverNoLossNoDuplication kills the leader mid-cluster and
+// verifies the entries it committed before dying survive on the remaining
+// peers, the newly elected leader can keep committing, and nothing is
+// ever applied twice.
+func TestLeaderFailoverNoLossNoDuplication(t *testing.T) {
+	peers := startTestCluster(t, 3)
+
+	leaderIdx := waitForLeader(t, peers, 2*time.Second)
+	leader := peers[leaderIdx]
+
+	if _, _, isLeader := leader.raft.Propose(Entry{Kind: EntryUploadBatch, Uuid: 1}); !isLeader {
+		t.Fatalf("peer %d believed it was leader but Propose disagreed", leaderIdx)
+	}
+
+	var survivors []*testPeer
+	for i, p := range peers {
+		if i != leaderIdx {
+			survivors = append(survivors, p)
+		}
+	}
+	for _, p := range survivors {
+		waitForUuid(t, p, 1, 2*time.Second)
+	}
+
+	// Kill the leader: stop its background loops so it sends no more
+	// heartbeats, and close its listener so new connections to it are
+	// refused. Connections it already accepted stay open and its RPC
+	// handlers still answer on them.
+	leader.raft.Stop()
+	leader.listener.Close()
+
+	newLeaderIdx := waitForLeader(t, survivors, 2*time.Second)
+	newLeader := survivors[newLeaderIdx]
+
+	if _, _, isLeader := newLeader.raft.Propose(Entry{Kind: EntryUploadBatch, Uuid: 2}); !isLeader {
+		t.Fatalf("new leader's Propose disagreed that it is leader")
+	}
+	for _, p := range survivors {
+		waitForUuid(t, p, 2, 2*time.Second)
+	}
+
+	for _, p := range survivors {
+		uuids := p.appliedUuids()
+		seen := map[int64]int{}
+		for _, u := range uuids {
+			seen[u]++
+		}
+		if seen[1] != 1 {
+			t.Errorf("peer applied uuid 1 %d times, want exactly 1 (applied: %v)", seen[1], uuids)
+		}
+		if seen[2] != 1 {
+			t.Errorf("peer applied uuid 2 %d times, want exactly 1 (applied: %v)", seen[2], uuids)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"time"
+)
+
+// rpcCallTimeout bounds how long call waits for a single RequestVote/
+// AppendEntries round trip. Peers call each other on every heartbeat
+// (heartbeatInterval) and every election; a peer that's merely
+// unresponsive (e.g. a half-open TCP connection, not connection-refused)
+// must not be able to block one of these goroutines forever -- each tick
+// spawns a fresh one, so an unbounded call leaks them without limit.
+const rpcCallTimeout = 2 * heartbeatInterval
+
+// callWithTimeout invokes an RPC via client.Go and bounds the wait by
+// rpcCallTimeout, instead of the indefinite block client.Call gives no
+// way to escape.
+func callWithTimeout(client *rpc.Client, method string, args, reply interface{}) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case c := <-call.Done:
+		return c.Error
+	case <-time.After(rpcCallTimeout):
+		return fmt.Errorf("rpc %s timed out after %v", method, rpcCallTimeout)
+	}
+}
+
+// RequestVoteArgs is the RequestVote RPC sent by a candidate to its peers.
+type RequestVoteArgs struct {
+	Term         int
+	CandidateId  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+// RequestVoteReply is the candidate's peer's response.
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+// AppendEntriesArgs is both the heartbeat and log-replication RPC sent by
+// the leader to its followers.
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderId     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []Entry
+	LeaderCommit int
+}
+
+// AppendEntriesReply is a follower's response to AppendEntries.
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+}
+
+// RequestVote handles a RequestVote RPC from a candidate. It is exported
+// so that net/rpc can dispatch to it once the peer registers this Raft.
+func (r *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if args.Term < r.currentTerm {
+		reply.Term = r.currentTerm
+		reply.VoteGranted = false
+		return nil
+	}
+
+	if args.Term > r.currentTerm {
+		r.becomeFollower(args.Term)
+	}
+	reply.Term = r.currentTerm
+
+	canVote := r.votedFor == -1 || r.votedFor == args.CandidateId
+	if canVote && r.logUpToDateLocked(args.LastLogTerm, args.LastLogIndex) {
+		r.votedFor = args.CandidateId
+		r.persistLocked()
+		reply.VoteGranted = true
+		r.kickElectionTimer()
+	} else {
+		reply.VoteGranted = false
+	}
+
+	return nil
+}
+
+// AppendEntries handles an AppendEntries RPC (heartbeat or replication)
+// from the current leader.
+func (r *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	r.mu.Lock()
+
+	if args.Term < r.currentTerm {
+		reply.Term = r.currentTerm
+		reply.Success = false
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.kickElectionTimer()
+	if args.Term > r.currentTerm || r.state == Candidate {
+		r.becomeFollower(args.Term)
+	}
+	r.leaderId = args.LeaderId
+	reply.Term = r.currentTerm
+
+	if args.PrevLogIndex >= 0 {
+		if args.PrevLogIndex >= len(r.log) || r.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+			reply.Success = false
+			r.mu.Unlock()
+			return nil
+		}
+	}
+
+	for i, e := range args.Entries {
+		idx := args.PrevLogIndex + 1 + i
+		if idx < len(r.log) && r.log[idx].Term != e.Term {
+			r.log = r.log[:idx]
+		}
+		if idx >= len(r.log) {
+			r.log = append(r.log, e)
+		}
+	}
+	r.persistLocked()
+
+	var newlyCommitted []Entry
+	if args.LeaderCommit > r.commitIndex {
+		newCommit := args.LeaderCommit
+		if newCommit > len(r.log)-1 {
+			newCommit = len(r.log) - 1
+		}
+		newlyCommitted = r.commitThroughLocked(newCommit)
+	}
+
+	reply.Success = true
+	r.mu.Unlock()
+
+	// Deliver outside the lock -- see the comment on replicateTo's call
+	// to deliver() for why this can't happen while r.mu is held.
+	r.deliver(newlyCommitted)
+
+	return nil
+}
+
+// call invokes a Raft RPC on the given peer, dialing lazily and caching
+// the connection for reuse.
+func (r *Raft) call(peer int, method string, args, reply interface{}) error {
+	r.mu.Lock()
+	client := r.peers[peer]
+	addr := r.peerAddrs[peer]
+	r.mu.Unlock()
+
+	if client == nil {
+		var err error
+		client, err = rpc.DialHTTP("tcp", addr)
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.peers[peer] = client
+		r.mu.Unlock()
+	}
+
+	if err := callWithTimeout(client, method, args, reply); err != nil {
+		r.mu.Lock()
+		if r.peers[peer] == client {
+			r.peers[peer] = nil
+		}
+		r.mu.Unlock()
+		return errors.New("raft: rpc " + method + " to " + addr + " failed: " + err.Error())
+	}
+	return nil
+}
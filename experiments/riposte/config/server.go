@@ -3,6 +3,7 @@ package db
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"log"
@@ -10,6 +11,7 @@ import (
 	"net/rpc"
 	"time"
 
+	"bitbucket.org/henrycg/riposte/config/raft"
 	"bitbucket.org/henrycg/riposte/utils"
 	"bitbucket.org/henrycg/zkp/group"
 )
@@ -17,6 +19,24 @@ import (
 // Time to wait between merges (in seconds)
 const MERGE_TIME_DELAY time.Duration = 60 * 60 * 24
 
+// rpcTimeout bounds how long the pipeline will wait for a single Prepare/
+// Commit/Audit/merge RPC to a peer. A replica that's merely slow (rather
+// than dead) must not be able to stall the pipeline goroutine forever.
+const rpcTimeout = 5 * time.Second
+
+// callWithTimeout invokes an RPC via client.Go and bounds the wait by
+// rpcTimeout, instead of the indefinite block that client.Call gives no
+// way to escape.
+func callWithTimeout(client *rpc.Client, serviceMethod string, args, reply interface{}) error {
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case c := <-call.Done:
+		return c.Error
+	case <-time.After(rpcTimeout):
+		return fmt.Errorf("rpc %s timed out after %v", serviceMethod, rpcTimeout)
+	}
+}
+
 var (
 	incomingReqs = make(chan [NUM_SERVERS]EncryptedInsertQuery, REQ_BUFFER_SIZE)
 	auditReqs    = make(chan AuditArgs, REQ_BUFFER_SIZE)
@@ -28,7 +48,87 @@ var (
 )
 
 func (t *Server) isLeader() bool {
-	return (t.ServerIdx == 0)
+	return t.raft.IsLeader()
+}
+
+// IsLeader reports whether this server currently believes it is the
+// leader of the pipeline's Raft group.
+func (t *Server) IsLeader() bool {
+	return t.raft.IsLeader()
+}
+
+// LeaderAddr returns the RPC address of the server this node last heard
+// was leader, or "" if it doesn't know yet (e.g. an election is underway).
+func (t *Server) LeaderAddr() string {
+	return t.raft.LeaderAddr()
+}
+
+// raftApplyLoop just drains t.raftApplyCh. On the server that originated
+// an entry (the leader that called Propose), the corresponding pipeline
+// action has already been taken directly -- submitPrepares/submitAudits
+// push straight onto auditReqs/commitReqs rather than waiting for the
+// entry to come back around through Raft. Acting on it again here would
+// double-run PREPARE/AUDIT/COMMIT. The log is instead consulted directly,
+// by uuid, when a newly elected leader resumes pending work (see
+// resumePendingOnElection) -- so this loop's only job is to keep taking
+// entries off the channel so the Raft peer's replicateTo/AppendEntries
+// callers (which deliver into this channel) never block on a full buffer.
+func (t *Server) raftApplyLoop() {
+	for range t.raftApplyCh {
+	}
+}
+
+// resumePendingOnElection is run whenever this server becomes leader. Any
+// uuid whose PREPARE (EntryUploadBatch) was committed to the Raft log but
+// whose decision (EntryCommit) was not needs its AUDIT/COMMIT phases
+// replayed. Resuming AUDIT correctly requires the actual audit-query
+// ciphertexts computed at the end of the original PREPARE phase -- those
+// are looked up from the log's EntryAuditResult payload, not re-derived,
+// since re-deriving them would require re-running PREPARE against
+// replicas that may have already applied it.
+func (t *Server) resumePendingOnElection() {
+	for _, uuid := range t.raft.PendingUuids() {
+		payload := t.raft.AuditPayload(uuid)
+		if payload == nil {
+			// The old leader died before the PREPARE round's replies were
+			// gathered and logged, so there's nothing durable to resume
+			// AUDIT with for this uuid. Safely recovering would mean
+			// re-running PREPARE from scratch, which submitPrepares isn't
+			// structured to do for an already-chosen uuid; surface this
+			// loudly instead of enqueueing a request with no ciphertexts.
+			log.Printf("raft: cannot resume uuid %d after leader change: no audit payload logged", uuid)
+			continue
+		}
+
+		queriesToAudit, err := decodeAuditQueries(payload)
+		if err != nil {
+			log.Printf("raft: cannot resume uuid %d after leader change: %v", uuid, err)
+			continue
+		}
+
+		log.Printf("raft: resuming pipeline for uuid %d after leader change", uuid)
+		auditReqs <- AuditArgs{Uuid: uuid, QueriesToAudit: queriesToAudit}
+	}
+}
+
+// encodeAuditQueries/decodeAuditQueries serialize AuditArgs.QueriesToAudit
+// for the raft log's opaque Entry.Payload, so a resumed leader can read
+// back the exact ciphertexts an earlier leader computed from the PREPARE
+// replies.
+func encodeAuditQueries(queries [][NUM_SERVERS]EncryptedAuditQuery) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(queries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeAuditQueries(payload []byte) ([][NUM_SERVERS]EncryptedAuditQuery, error) {
+	var queries [][NUM_SERVERS]EncryptedAuditQuery
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&queries); err != nil {
+		return nil, err
+	}
+	return queries, nil
 }
 
 // Upload from client to leader
@@ -50,13 +150,21 @@ func (t *Server) isLeader() bool {
  */
 
 func (t *Server) Upload(args *UploadArgs, reply *UploadReply) error {
+	defer t.inFlight()()
+
 	if !t.isLeader() {
-		return errors.New("Only leader can accept uploads")
+		reply.LeaderAddr = t.raft.LeaderAddr()
+		// net/rpc does not send the reply body back when a handler returns
+		// an error, so the leader's address also goes in the error text.
+		return fmt.Errorf("Only leader can accept uploads; leader is at %q", reply.LeaderAddr)
 	}
 
 	log.Printf("Got upload request")
 	//log.Printf("Request:", args)
 
+	if t.State == State_Draining {
+		return errDraining
+	}
 	if t.State != State_AcceptUpload {
 		return errors.New("Not accepting uploads")
 	}
@@ -122,8 +230,12 @@ func readIncomingRequests(preps *[NUM_SERVERS]PrepareArgs,
 	return n
 }
 
-func (t *Server) submitPrepares() {
+func (t *Server) submitPrepares() error {
 	for {
+		// Don't bail out here on t.shutdownCh: we must keep reading
+		// incomingReqs until we actually see (and forward) the drain
+		// marker below, or submitAudits/submitCommits would block
+		// forever waiting for a marker that never arrives.
 		uuid, err := utils.RandomInt64(math.MaxInt64)
 		if err != nil {
 			log.Printf("error in random")
@@ -141,16 +253,25 @@ func (t *Server) submitPrepares() {
 		if n == 0 {
 			// Merge is starting, so send marker down pipeline
 			auditReqs <- beginMergeMarkerAudit
+			if t.State == State_Draining {
+				// Nothing left to prepare and everything in flight has
+				// been flushed down the pipeline -- safe to stop.
+				return nil
+			}
 		}
 
 		log.Printf("Send PREPARE %d", uuid)
 
+		// Replicate that this uuid's batch has entered the pipeline, so a
+		// newly elected leader knows to resume it if we die before COMMIT.
+		t.raft.Propose(raft.Entry{Kind: raft.EntryUploadBatch, Uuid: uuid})
+
 		// Send out PREPARE request
 		c := make(chan error, NUM_SERVERS)
 		var replies [NUM_SERVERS]PrepareReply
 		for i := 0; i < NUM_SERVERS; i++ {
 			go func(prep *PrepareArgs, reply *PrepareReply, j int) {
-				err := t.rpcClients[j].Call("Server.Prepare", prep, reply)
+				err := callWithTimeout(t.rpcClients[j], "Server.Prepare", prep, reply)
 				if err != nil {
 					c <- err
 				} else {
@@ -164,7 +285,8 @@ func (t *Server) submitPrepares() {
 		for i := 0; i < NUM_SERVERS; i++ {
 			r = <-c
 			if r != nil {
-				log.Fatal("Error in prepare: ", r)
+				log.Printf("Error in prepare, stopping pipeline: %v", r)
+				return r
 			}
 		}
 
@@ -199,6 +321,18 @@ func (t *Server) submitPrepares() {
 		}
 
 		if okay {
+			// Replicate the audit-query ciphertexts themselves, not just
+			// the uuid: if we die before submitAudits gets to this uuid, a
+			// newly elected leader has nothing to send the Auditor unless
+			// the actual ciphertexts -- computed just now from the PREPARE
+			// replies -- are durable somewhere it can read them back from.
+			payload, err := encodeAuditQueries(auditArgs.QueriesToAudit)
+			if err != nil {
+				log.Printf("Error encoding audit payload for raft log %v: %v", uuid, err)
+			} else {
+				t.raft.Propose(raft.Entry{Kind: raft.EntryAuditResult, Uuid: uuid, Payload: payload})
+			}
+
 			log.Printf("Putting audit request in pipeline %d", uuid)
 			auditReqs <- auditArgs
 		} else {
@@ -207,30 +341,36 @@ func (t *Server) submitPrepares() {
 			var commitArgs CommitArgs
 			commitArgs.Uuid = preps[0].Uuid
 			commitArgs.Commit = make([]bool, len(replies[0].QueryToAudit))
+			t.raft.Propose(raft.Entry{Kind: raft.EntryCommit, Uuid: commitArgs.Uuid, Okays: commitArgs.Commit})
 			commitReqs <- commitArgs
 		}
 	}
 }
 
-func (t *Server) submitAudits() {
+func (t *Server) submitAudits() error {
 	for {
 		req := <-auditReqs
 		log.Printf("Send AUDIT %d", req.Uuid)
 		if req.Uuid == beginMergeMarkerCommit.Uuid {
 			commitReqs <- beginMergeMarkerCommit
+			if t.State == State_Draining {
+				return nil
+			}
 			continue
 		}
 
 		// Send out AUDIT request
 		var a_reply AuditReply
-		err := t.rpcClients[AUDIT_SERVER].Call("Auditor.Audit", req, &a_reply)
+		err := callWithTimeout(t.rpcClients[AUDIT_SERVER], "Auditor.Audit", req, &a_reply)
 		if err != nil {
-			log.Fatal("Error in audit: ", err)
+			log.Printf("Error in audit, stopping pipeline: %v", err)
+			return err
 		}
 
 		var commitArgs CommitArgs
 		commitArgs.Uuid = req.Uuid
 		commitArgs.Commit = a_reply.Okay
+		t.raft.Propose(raft.Entry{Kind: raft.EntryCommit, Uuid: req.Uuid, Okays: a_reply.Okay})
 		commitReqs <- commitArgs
 		for i := range a_reply.Okay {
 			if !a_reply.Okay[i] {
@@ -242,10 +382,17 @@ func (t *Server) submitAudits() {
 	}
 }
 
-func (t *Server) submitCommits() {
+func (t *Server) submitCommits() error {
 	for {
 		com := <-commitReqs
 		if com.Uuid == beginMergeMarkerCommit.Uuid {
+			if t.State == State_Draining {
+				// This marker was injected by Shutdown or stepDownPipeline
+				// to flush the pipeline, not by beginMerge -- everything
+				// ahead of it has already been committed, so there's
+				// nothing to merge and no reason to force one early.
+				return nil
+			}
 			t.sendMergeRequest()
 		}
 		log.Printf("Send COMMIT %d", com.Uuid)
@@ -255,7 +402,7 @@ func (t *Server) submitCommits() {
 		var replies [NUM_SERVERS]CommitReply
 		for i := 0; i < NUM_SERVERS; i++ {
 			go func(com *CommitArgs, reply *CommitReply, j int) {
-				err := t.rpcClients[j].Call("Server.Commit", com, reply)
+				err := callWithTimeout(t.rpcClients[j], "Server.Commit", com, reply)
 				if err != nil {
 					c <- err
 				} else {
@@ -269,7 +416,8 @@ func (t *Server) submitCommits() {
 		for i := 0; i < NUM_SERVERS; i++ {
 			r = <-c
 			if r != nil {
-				log.Fatal("Error in commit: ", r)
+				log.Printf("Error in commit, stopping pipeline: %v", r)
+				return r
 			}
 			log.Printf("Got commit %v/%v", i, NUM_SERVERS)
 		}
@@ -278,21 +426,39 @@ func (t *Server) submitCommits() {
 	}
 }
 
-func (t *Server) mergeWorker() {
+// runMergeWorker periodically triggers a merge until the server shuts
+// down entirely (t.shutdownCh) or this leadership epoch ends
+// (epochStopCh) -- whichever comes first.
+func (t *Server) runMergeWorker(epochStopCh chan struct{}) {
+	defer t.pipelineWg.Done()
 	for {
-		time.Sleep(MERGE_TIME_DELAY * time.Second)
-		t.sendMergeRequest()
+		select {
+		case <-t.shutdownCh:
+			return
+		case <-epochStopCh:
+			return
+		case <-time.After(MERGE_TIME_DELAY * time.Second):
+			t.sendMergeRequest()
+		}
 	}
 }
 
 func (t *Server) sendMergeRequest() {
+	// Record that a merge began, so the log reflects every pipeline
+	// transition (even though, unlike UPLOAD_BATCH/AUDIT_RESULT/COMMIT,
+	// nothing currently resumes a merge from this entry on its own --
+	// sendMergeRequest is reached either via the merge marker flowing
+	// through incomingReqs/auditReqs/commitReqs or directly from
+	// runMergeWorker's timer).
+	t.raft.Propose(raft.Entry{Kind: raft.EntryBeginMerge})
+
 	// Call each server and ask for their data
 	// Send out COMMIT request
 	c := make(chan error, NUM_SERVERS)
 	var replies [NUM_SERVERS]DumpReply
 	for i := 0; i < NUM_SERVERS; i++ {
 		go func(reply *DumpReply, j int) {
-			err := t.rpcClients[j].Call("Server.DumpTable", 0, reply)
+			err := callWithTimeout(t.rpcClients[j], "Server.DumpTable", 0, reply)
 			if err != nil {
 				c <- err
 			} else {
@@ -318,7 +484,7 @@ func (t *Server) sendMergeRequest() {
 	for i := 0; i < NUM_SERVERS; i++ {
 		go func(j int) {
 			var p_reply PlaintextReply
-			err := t.rpcClients[j].Call("Server.StorePlaintext", &parg, &p_reply)
+			err := callWithTimeout(t.rpcClients[j], "Server.StorePlaintext", &parg, &p_reply)
 			c <- err
 		}(i)
 	}
@@ -365,6 +531,8 @@ func (t *Server) beginMerge() {
  */
 
 func (t *Server) Prepare(prep *PrepareArgs, reply *PrepareReply) error {
+	defer t.inFlight()()
+
 	var err error
 	plainQueries := make([]*InsertQuery, len(prep.Queries))
 	reply.QueryToAudit = make([]EncryptedAuditQuery, len(prep.Queries))
@@ -411,6 +579,16 @@ func (t *Server) Prepare(prep *PrepareArgs, reply *PrepareReply) error {
 		<-c
 	}
 
+	// Record the tentative XOR durably before replying, so a crash before
+	// the matching Commit can be undone on restart by replaying the WAL.
+	// rows is the same row-index slice processQueries just used to XOR
+	// the tentative insert in, so it's exactly what the spec calls for.
+	if err := t.wal.AppendPrepare(prep.Uuid, plainQueries, rows); err != nil {
+		log.Printf("Error writing WAL for %v: %v", prep.Uuid, err)
+		reply.Okay = false
+		return err
+	}
+
 	reply.Okay = true
 	t.pendingMutex.Lock()
 	t.pending[prep.Uuid] = plainQueries
@@ -420,6 +598,8 @@ func (t *Server) Prepare(prep *PrepareArgs, reply *PrepareReply) error {
 }
 
 func (t *Server) Commit(com *CommitArgs, reply *CommitReply) error {
+	defer t.inFlight()()
+
 	t.pendingMutex.Lock()
 	queries, ok := t.pending[com.Uuid]
 	t.pendingMutex.Unlock()
@@ -429,6 +609,16 @@ func (t *Server) Commit(com *CommitArgs, reply *CommitReply) error {
 		return err
 	}
 
+	// Durably record which queries were judged bogus *before* touching the
+	// table: if we crash partway through removing them, replayWAL needs
+	// this decision on disk to redo exactly the bogus removal on restart
+	// instead of undoing the whole PREPARE (which would also strip out
+	// the good queries this Commit is supposed to keep).
+	if err := t.wal.AppendCommitDecision(com.Uuid, com.Commit); err != nil {
+		log.Printf("Error writing commit decision to WAL for %v: %v", com.Uuid, err)
+		return err
+	}
+
 	bogus := make([]*InsertQuery, 0)
 	for i := range queries {
 		if !com.Commit[i] {
@@ -443,6 +633,10 @@ func (t *Server) Commit(com *CommitArgs, reply *CommitReply) error {
 		t.entries.processQueries(bogus)
 	}
 
+	if err := t.wal.AppendCommit(com.Uuid); err != nil {
+		log.Printf("Error truncating WAL for %v: %v", com.Uuid, err)
+	}
+
 	t.pendingMutex.Lock()
 	delete(t.pending, com.Uuid)
 	t.pendingMutex.Unlock()
@@ -460,6 +654,8 @@ func (t *Server) Commit(com *CommitArgs, reply *CommitReply) error {
 }
 
 func (t *Server) StorePlaintext(args *PlaintextArgs, reply *PlaintextReply) error {
+	defer t.inFlight()()
+
 	t.clientsServedMutex.Lock()
 	t.clientsServed = 0
 	t.clientsServedStart = time.Now()
@@ -481,6 +677,10 @@ func (t *Server) StorePlaintext(args *PlaintextArgs, reply *PlaintextReply) erro
 	*/
 	t.plainMutex.Unlock()
 
+	if err := t.wal.Truncate(); err != nil {
+		log.Printf("Error truncating WAL after merge: %v", err)
+	}
+
 	t.State = State_AcceptUpload
 
 	MemCleanup()
@@ -488,6 +688,8 @@ func (t *Server) StorePlaintext(args *PlaintextArgs, reply *PlaintextReply) erro
 }
 
 func (t *Server) DumpTable(_ *int, reply *DumpReply) error {
+	defer t.inFlight()()
+
 	log.Printf("Dumping table %d\n", t.ServerIdx)
 	reply.Entries = new(BitMatrix)
 	t.entries.CopyToAndClear(reply.Entries)
@@ -545,21 +747,87 @@ func (t *Server) openConnections() error {
 }
 
 func (t *Server) Initialize(*int, *int) error {
-	if t.isLeader() {
-		go t.submitPrepares()
-		go t.submitAudits()
-		go t.submitCommits()
-		go t.mergeWorker()
-		go func(t *Server) {
-			// HACK wait until other servers have started
-			time.Sleep(500 * time.Millisecond)
-			err := t.openConnections()
-			if err != nil {
-				log.Fatal("Could not initialize table", err)
+	go t.raftApplyLoop()
+	go t.watchLeadership()
+	return nil
+}
+
+// watchLeadership polls this server's Raft membership. Each time it
+// becomes leader it starts the pipeline goroutines and resumes any uuid
+// left mid-pipeline by the previous leader; each time it stops being
+// leader (partition heals, a brief network blip, ...) it stops them
+// again, so a later re-election never finds a stale epoch's goroutines
+// still racing the new one over the shared pipeline channels.
+func (t *Server) watchLeadership() {
+	wasLeader := false
+	var epochStopCh chan struct{}
+	for {
+		select {
+		case <-t.shutdownCh:
+			// Shutdown is draining (or has already drained) the pipeline
+			// and is about to close rpcClients/the listener: stop polling
+			// for good so a leadership flip afterward (a stale vote, a
+			// late heartbeat) can't re-add workers to t.pipelineWg and
+			// restart submitPrepares/submitAudits/submitCommits against
+			// connections Shutdown has already torn down.
+			return
+		default:
+		}
+		isLeader := t.raft.IsLeader()
+		switch {
+		case isLeader && !wasLeader:
+			// Re-check t.shutdownCh under t.leadershipMu, the same lock
+			// Shutdown holds while closing it: without this, the select
+			// above and this Add can straddle Shutdown's close(shutdownCh),
+			// racing this Add(4) against Shutdown's concurrent
+			// t.pipelineWg.Wait() goroutine -- a WaitGroup misuse ("Add
+			// called concurrently with Wait") Go's race detector (and
+			// sometimes the runtime itself) will catch.
+			t.leadershipMu.Lock()
+			select {
+			case <-t.shutdownCh:
+				t.leadershipMu.Unlock()
+				return
+			default:
 			}
-		}(t)
+			log.Printf("server %d: became leader, starting pipeline", t.ServerIdx)
+			epochStopCh = make(chan struct{})
+			t.pipelineWg.Add(4)
+			t.leadershipMu.Unlock()
+			go t.runPipelineStage(t.submitPrepares)
+			go t.runPipelineStage(t.submitAudits)
+			go t.runPipelineStage(t.submitCommits)
+			go t.runMergeWorker(epochStopCh)
+			go func(t *Server) {
+				// HACK wait until other servers have started
+				time.Sleep(500 * time.Millisecond)
+				if err := t.openConnections(); err != nil {
+					log.Printf("Could not initialize table: %v", err)
+				}
+			}(t)
+			t.resumePendingOnElection()
+
+		case !isLeader && wasLeader:
+			log.Printf("server %d: lost leadership, stopping pipeline", t.ServerIdx)
+			t.stepDownPipeline(epochStopCh)
+			epochStopCh = nil
+		}
+		wasLeader = isLeader
+		time.Sleep(50 * time.Millisecond)
 	}
-	return nil
+}
+
+// stepDownPipeline stops the current epoch's pipeline goroutines after
+// this server loses leadership: it stops runMergeWorker immediately, then
+// flushes whatever batch is already in flight through PREPARE/AUDIT/
+// COMMIT by injecting the same drain marker Shutdown uses, and blocks
+// until all four goroutines have returned -- so the next "became leader"
+// transition starts from a clean slate.
+func (t *Server) stepDownPipeline(epochStopCh chan struct{}) {
+	t.State = State_Draining
+	close(epochStopCh)
+	incomingReqs <- beginMergeMarker
+	t.pipelineWg.Wait()
 }
 
 func elementsToBytes(elms []group.Element) []byte {
@@ -603,9 +871,67 @@ func NewServer(serverIdx int, serverAddrs []string) *Server {
 	t.clientsServedStart = time.Now()
 	t.pending = map[int64]([]*InsertQuery){}
 
+	raftStatePath := fmt.Sprintf("raft-state-%d.dat", serverIdx)
+	t.raftApplyCh = make(chan raft.ApplyMsg, REQ_BUFFER_SIZE)
+	t.raft = raft.NewRaft(serverIdx, serverAddrs, raft.NewFilePersister(raftStatePath), t.raftApplyCh)
+
+	walPath := fmt.Sprintf("wal-%d.dat", serverIdx)
+	wal, err := NewFileWAL(walPath, PerRecordFsync)
+	if err != nil {
+		log.Fatal("Could not open WAL: ", err)
+	}
+	t.wal = wal
+	t.replayWAL()
+
+	t.shutdownCh = make(chan struct{})
+	t.pipelineErrCh = make(chan error, 1)
+
 	return t
 }
 
+// replayWAL resolves every record left dangling by a crash somewhere
+// between Prepare and Commit finishing.
+//
+// A record with no commit decision (rec.Commit == nil) means Commit never
+// ran for this uuid at all, so the whole tentative PREPARE insert is
+// undone: re-XOR the recorded queries (XOR is its own inverse) to remove
+// it.
+//
+// A record with a commit decision means Commit had already decided which
+// queries were bogus -- durably, before it touched the table -- but we
+// don't know whether it finished applying that decision before the
+// crash. Rather than undo the whole batch (which would also strip out
+// the good queries the decision says to keep), replay redoes exactly the
+// bogus removal the decision specifies.
+func (t *Server) replayWAL() {
+	recs, err := t.wal.Pending()
+	if err != nil {
+		log.Fatal("Could not read WAL: ", err)
+	}
+
+	for _, rec := range recs {
+		if rec.Commit != nil {
+			log.Printf("Redoing dangling COMMIT %v found in WAL", rec.Uuid)
+			bogus := make([]*InsertQuery, 0)
+			for i, okay := range rec.Commit {
+				if !okay {
+					bogus = append(bogus, rec.Queries[i])
+				}
+			}
+			if len(bogus) > 0 {
+				t.entries.processQueries(bogus)
+			}
+		} else {
+			log.Printf("Rolling back dangling PREPARE %v found in WAL", rec.Uuid)
+			t.entries.processQueries(rec.Queries)
+		}
+		if err := t.wal.AppendCommit(rec.Uuid); err != nil {
+			log.Printf("Error truncating WAL for %v: %v", rec.Uuid, err)
+		}
+		delete(t.pending, rec.Uuid)
+	}
+}
+
 func (t *Server) DoNothing(args *int, reply *int) error {
 	// Just use this to test number
 	// of requests can handle in a second
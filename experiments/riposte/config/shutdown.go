@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runPipelineStage runs one of the pipeline goroutines (submitPrepares,
+// submitAudits, submitCommits), recording its error (if any) and marking
+// it done on t.pipelineWg so Shutdown can wait for quiescence.
+func (t *Server) runPipelineStage(stage func() error) {
+	defer t.pipelineWg.Done()
+	if err := stage(); err != nil {
+		select {
+		case t.pipelineErrCh <- err:
+		default:
+		}
+	}
+}
+
+// inFlight marks the start of an inbound RPC (Prepare, Commit, Upload,
+// ...) on t.rpcWg and returns a func to call when it finishes, so
+// Shutdown can wait for every in-progress handler to return before
+// closing the listener and peer connections out from under it.
+func (t *Server) inFlight() func() {
+	t.rpcWg.Add(1)
+	return t.rpcWg.Done
+}
+
+// Shutdown drains the pipeline and stops the server gracefully: it stops
+// accepting new uploads, flushes every batch already in flight through
+// PREPARE/AUDIT/COMMIT, waits for the pipeline goroutines and every
+// in-flight inbound RPC to quiesce, closes the RPC connections to peers,
+// and fsyncs the WAL. It returns ctx.Err() if ctx is done before the
+// drain completes. Shutdown is idempotent -- a caller may retry it after
+// a timed-out attempt.
+//
+// Shutdown has no test in this package: Server, SlotTable and the
+// Upload/Prepare/Commit RPC types it runs on are not declared in these
+// files. wal_test.go covers the WAL record sequencing that Prepare and
+// Commit rely on.
+func (t *Server) Shutdown(ctx context.Context) error {
+	t.shutdownOnce.Do(func() {
+		log.Printf("server %d: shutting down", t.ServerIdx)
+
+		// Hold t.leadershipMu across the State flip and the shutdownCh
+		// close -- the same lock watchLeadership's became-leader branch
+		// takes before its own re-check of t.shutdownCh and its
+		// t.pipelineWg.Add(4). Without it, that check-then-Add could
+		// straddle this close and race the t.pipelineWg.Wait() goroutine
+		// started below.
+		t.leadershipMu.Lock()
+		t.State = State_Draining
+		close(t.shutdownCh)
+		t.leadershipMu.Unlock()
+
+		// Flush any batch that's still sitting in incomingReqs through the
+		// pipeline so Prepare/Audit/Commit get a chance to finish cleanly.
+		incomingReqs <- beginMergeMarker
+	})
+
+	done := make(chan struct{})
+	go func() {
+		t.pipelineWg.Wait()
+		// Wait for in-flight inbound RPCs too -- draining the pipeline
+		// only means this server is done calling out to peers, not that
+		// every Prepare/Commit/DumpTable/etc. a peer is currently calling
+		// on it has returned. Closing the listener and rpcClients while
+		// one is still executing would race a handler against its own
+		// transport.
+		t.rpcWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Stop this peer's own Raft background loops (electionTimerLoop, and
+	// heartbeatLoop if it's leader) now that the pipeline and every
+	// in-flight RPC have quiesced -- watchLeadership returns at its next
+	// poll of t.shutdownCh, and its became-leader branch re-checks
+	// t.shutdownCh before starting anything, so no new pipeline epoch can
+	// start.
+	t.raft.Stop()
+
+	for _, client := range t.rpcClients {
+		if client != nil {
+			client.Close()
+		}
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+	}
+
+	if err := t.wal.Sync(); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-t.pipelineErrCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+// errDraining is returned by Upload once Shutdown has begun.
+var errDraining = errors.New("server is shutting down")
+
+// shutdownSignalTimeout bounds how long ListenForShutdownSignals waits
+// for Shutdown's drain before giving up and returning -- a signal should
+// get the process exiting in bounded time even if a peer RPC is wedged.
+const shutdownSignalTimeout = 30 * time.Second
+
+// ListenForShutdownSignals blocks until SIGINT, SIGTERM, or SIGQUIT is
+// received, then calls Shutdown and returns its error. Callers that want
+// a graceful drain on process termination should run this in its own
+// goroutine (or call it directly, if nothing else needs main's
+// goroutine) rather than relying on the runtime's default signal
+// handling, which kills the process without draining the pipeline.
+func (t *Server) ListenForShutdownSignals() error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	sig := <-sigCh
+
+	log.Printf("server %d: received %v, shutting down", t.ServerIdx, sig)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownSignalTimeout)
+	defer cancel()
+	return t.Shutdown(ctx)
+}
@@ -0,0 +1,341 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// WALRecordKind identifies whether a WAL record is the tentative PREPARE,
+// the durable COMMIT decision that supersedes it, or the final retire
+// that drops it from Pending() entirely.
+type WALRecordKind int
+
+const (
+	// WALPrepare is written before Prepare replies: Queries/Rows record
+	// the tentative insert so it can be undone if Commit never runs.
+	WALPrepare WALRecordKind = iota
+	// WALCommitDecided is written before Commit mutates the table: Commit
+	// carries which of Queries were judged bogus. A record left at this
+	// kind (Commit non-nil) after a crash means the decision was made but
+	// we don't know whether it was applied yet, so replay must redo it --
+	// re-removing exactly the bogus queries, not the whole batch.
+	WALCommitDecided
+	// WALCommit retires the record: the decision (if any) is known to
+	// have been applied, and replay has nothing left to do for this uuid.
+	WALCommit
+)
+
+// WALRecord is one entry in the write-ahead log: enough to redo or undo
+// the XOR a PREPARE tentatively applied to the table.
+type WALRecord struct {
+	Kind    WALRecordKind
+	Uuid    int64
+	Queries []*InsertQuery
+	Rows    []int
+	// Commit is nil until AppendCommitDecision has recorded which of
+	// Queries were judged bogus (Commit[i] == false) by the audit. Once
+	// non-nil, replay knows Commit() had begun and must redo exactly the
+	// bogus removal rather than undo the entire PREPARE.
+	Commit []bool
+}
+
+// FsyncPolicy controls how aggressively the WAL flushes to stable
+// storage: per-record (safest, slowest) or batched on an interval.
+type FsyncPolicy struct {
+	// PerRecord, if true, fsyncs after every Append. If false, the WAL
+	// fsyncs at most once every BatchInterval.
+	PerRecord     bool
+	BatchInterval time.Duration
+}
+
+// PerRecordFsync fsyncs the log to disk before every Prepare/Commit
+// returns -- the safest policy, and the default.
+var PerRecordFsync = FsyncPolicy{PerRecord: true}
+
+// BatchedFsync returns a policy that fsyncs at most once every interval,
+// trading durability for throughput. The fsync happens only inside an
+// append that finds the interval elapsed (or in Sync), so records written
+// since the last fsync stay unsynced until the next such append or Sync.
+func BatchedFsync(interval time.Duration) FsyncPolicy {
+	return FsyncPolicy{PerRecord: false, BatchInterval: interval}
+}
+
+// WAL is the write-ahead log that makes Prepare/Commit crash-safe: a
+// PREPARE's decrypted queries and the row indices they modified are
+// durably recorded before Server.Prepare replies, so a crash between
+// PREPARE and COMMIT can be undone by replaying the log on restart.
+type WAL interface {
+	// AppendPrepare durably records a PREPARE for uuid before Prepare
+	// replies to the caller.
+	AppendPrepare(uuid int64, queries []*InsertQuery, rows []int) error
+	// AppendCommitDecision durably records which of uuid's queries were
+	// judged bogus by the audit, before Commit mutates the table. It must
+	// be called -- and land on disk -- before the corresponding removal,
+	// so that a crash at any point afterward leaves enough information
+	// for replay to redo the removal instead of undoing the whole batch.
+	AppendCommitDecision(uuid int64, commit []bool) error
+	// AppendCommit records that uuid's COMMIT decision has been fully
+	// applied and retires its record; called after the removal above.
+	AppendCommit(uuid int64) error
+	// Truncate drops the whole log, once a merge has reset the table.
+	Truncate() error
+	// Pending returns the records not yet retired by AppendCommit, in the
+	// order their PREPAREs were written: WALPrepare records, which
+	// NewServer's replay undoes, and WALCommitDecided records, whose
+	// bogus removal it redoes.
+	Pending() ([]WALRecord, error)
+	// Sync forces any buffered records to stable storage, regardless of
+	// the configured FsyncPolicy -- used when draining on shutdown.
+	Sync() error
+}
+
+// FileWAL is the default, file-backed WAL.
+type FileWAL struct {
+	mu     sync.Mutex
+	path   string
+	policy FsyncPolicy
+
+	// file and enc are opened once and kept alive for the life of the
+	// WAL (recreated only by Truncate): a gob Encoder/Decoder pair forms
+	// a single continuous stream -- the Encoder tracks which types it
+	// has already written, and the Decoder expects that same, one-time
+	// type info at the head of the stream. Opening a fresh gob.Encoder
+	// on every append re-sends that type info into the middle of the
+	// file, which a single gob.Decoder reading the whole file back (as
+	// load does) rejects as a "duplicate type received" -- silently
+	// losing every record after the first.
+	file *os.File
+	enc  *gob.Encoder
+
+	dirty      bool
+	lastFsync  time.Time
+	pending    map[int64]WALRecord
+	pendingSeq []int64
+}
+
+// NewFileWAL opens (or creates) the WAL at path, applying the given fsync
+// policy, and loads any records already on disk.
+func NewFileWAL(path string, policy FsyncPolicy) (*FileWAL, error) {
+	w := &FileWAL{
+		path:    path,
+		policy:  policy,
+		pending: map[int64]WALRecord{},
+	}
+	if err := w.load(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := w.openForAppend(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// openForAppend (re)opens w.path and starts a fresh gob.Encoder writing
+// to it. Caller must hold w.mu, except during NewFileWAL.
+func (w *FileWAL) openForAppend() error {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.enc = gob.NewEncoder(f)
+	return nil
+}
+
+func (w *FileWAL) load() error {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	for {
+		var rec WALRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		switch rec.Kind {
+		case WALPrepare:
+			w.pending[rec.Uuid] = rec
+			w.pendingSeq = append(w.pendingSeq, rec.Uuid)
+		case WALCommitDecided:
+			// Supersedes the WALPrepare record already in w.pending for
+			// this uuid -- same slot in pendingSeq, updated Commit bitmap.
+			w.pending[rec.Uuid] = rec
+		case WALCommit:
+			delete(w.pending, rec.Uuid)
+		}
+	}
+	return nil
+}
+
+func (w *FileWAL) AppendPrepare(uuid int64, queries []*InsertQuery, rows []int) error {
+	rec := WALRecord{Kind: WALPrepare, Uuid: uuid, Queries: queries, Rows: rows}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[uuid] = rec
+	w.pendingSeq = append(w.pendingSeq, uuid)
+	return w.appendLocked(rec)
+}
+
+func (w *FileWAL) AppendCommitDecision(uuid int64, commit []bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	prior := w.pending[uuid]
+	rec := WALRecord{Kind: WALCommitDecided, Uuid: uuid, Queries: prior.Queries, Rows: prior.Rows, Commit: commit}
+	w.pending[uuid] = rec
+	return w.appendLocked(rec)
+}
+
+func (w *FileWAL) AppendCommit(uuid int64) error {
+	rec := WALRecord{Kind: WALCommit, Uuid: uuid}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.pending, uuid)
+	return w.appendLocked(rec)
+}
+
+func (w *FileWAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = map[int64]WALRecord{}
+	w.pendingSeq = nil
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(w.path, nil, 0600); err != nil {
+		return err
+	}
+	w.dirty = false
+	// The file is empty again, so a decoder replaying it from scratch
+	// expects fresh type info -- reopen with a new Encoder rather than
+	// keep writing through the one that already sent it once.
+	return w.openForAppend()
+}
+
+// Sync fsyncs the log file, regardless of the FsyncPolicy -- used to
+// make sure every acknowledged record is durable before shutdown.
+func (w *FileWAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+	return w.syncLocked()
+}
+
+func (w *FileWAL) Pending() ([]WALRecord, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	recs := make([]WALRecord, 0, len(w.pending))
+	for _, uuid := range w.pendingSeq {
+		if rec, ok := w.pending[uuid]; ok {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+// appendLocked appends rec to the on-disk log, fsyncing per the
+// configured policy. Caller must hold w.mu.
+func (w *FileWAL) appendLocked(rec WALRecord) error {
+	if err := w.enc.Encode(rec); err != nil {
+		return err
+	}
+	w.dirty = true
+
+	switch {
+	case w.policy.PerRecord:
+		return w.syncLocked()
+	case time.Since(w.lastFsync) >= w.policy.BatchInterval:
+		return w.syncLocked()
+	}
+	return nil
+}
+
+func (w *FileWAL) syncLocked() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	w.lastFsync = time.Now()
+	return nil
+}
+
+// MemoryWAL is an in-memory WAL for tests: it has the same undo/redo
+// semantics as FileWAL but never touches disk.
+type MemoryWAL struct {
+	mu         sync.Mutex
+	pending    map[int64]WALRecord
+	pendingSeq []int64
+}
+
+// NewMemoryWAL returns an empty in-memory WAL.
+func NewMemoryWAL() *MemoryWAL {
+	return &MemoryWAL{pending: map[int64]WALRecord{}}
+}
+
+func (w *MemoryWAL) AppendPrepare(uuid int64, queries []*InsertQuery, rows []int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[uuid] = WALRecord{Kind: WALPrepare, Uuid: uuid, Queries: queries, Rows: rows}
+	w.pendingSeq = append(w.pendingSeq, uuid)
+	return nil
+}
+
+func (w *MemoryWAL) AppendCommitDecision(uuid int64, commit []bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	prior := w.pending[uuid]
+	w.pending[uuid] = WALRecord{Kind: WALCommitDecided, Uuid: uuid, Queries: prior.Queries, Rows: prior.Rows, Commit: commit}
+	return nil
+}
+
+func (w *MemoryWAL) AppendCommit(uuid int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.pending, uuid)
+	return nil
+}
+
+func (w *MemoryWAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = map[int64]WALRecord{}
+	w.pendingSeq = nil
+	return nil
+}
+
+// Sync is a no-op: MemoryWAL has no stable storage to flush to.
+func (w *MemoryWAL) Sync() error {
+	return nil
+}
+
+func (w *MemoryWAL) Pending() ([]WALRecord, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	recs := make([]WALRecord, 0, len(w.pending))
+	for _, uuid := range w.pendingSeq {
+		if rec, ok := w.pending[uuid]; ok {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
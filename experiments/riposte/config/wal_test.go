@@ -0,0 +1,143 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestWALCommitDecisionSurvivesCrash exercises the record-kind sequencing
+// a crash between Commit's decision and its table mutation relies on:
+// AppendPrepare, then AppendCommitDecision (the durable point replay must
+// redo from), then the final AppendCommit retiring the uuid. It uses
+// MemoryWAL rather than FileWAL since the redo/undo semantics being
+// tested live entirely in the Kind/Commit bookkeeping, not in the file
+// format.
+func TestWALCommitDecisionSurvivesCrash(t *testing.T) {
+	w := NewMemoryWAL()
+	const uuid = int64(42)
+	queries := []*InsertQuery{{}, {}, {}}
+	rows := []int{1, 2, 3}
+
+	if err := w.AppendPrepare(uuid, queries, rows); err != nil {
+		t.Fatalf("AppendPrepare: %v", err)
+	}
+
+	pending, err := w.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Kind != WALPrepare || pending[0].Commit != nil {
+		t.Fatalf("after AppendPrepare, Pending = %+v, want one WALPrepare record with Commit == nil", pending)
+	}
+
+	// Simulate the audit finding query 1 bogus: AppendCommitDecision must
+	// land -- and be visible via Pending -- before Commit touches the
+	// table, so a crash right after this call still has enough on disk
+	// for replayWAL to redo exactly the bogus removal.
+	commit := []bool{true, false, true}
+	if err := w.AppendCommitDecision(uuid, commit); err != nil {
+		t.Fatalf("AppendCommitDecision: %v", err)
+	}
+
+	pending, err = w.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("after AppendCommitDecision, Pending has %d records, want 1", len(pending))
+	}
+	rec := pending[0]
+	if rec.Kind != WALCommitDecided {
+		t.Fatalf("after AppendCommitDecision, Kind = %v, want WALCommitDecided", rec.Kind)
+	}
+	if len(rec.Queries) != len(queries) || len(rec.Rows) != len(rows) {
+		t.Fatalf("AppendCommitDecision record lost the original Queries/Rows: %+v", rec)
+	}
+	if len(rec.Commit) != len(commit) || rec.Commit[1] != false {
+		t.Fatalf("AppendCommitDecision record Commit = %v, want %v", rec.Commit, commit)
+	}
+
+	// Once the bogus removal has actually been applied to the table,
+	// AppendCommit retires the record -- replay has nothing left to do.
+	if err := w.AppendCommit(uuid); err != nil {
+		t.Fatalf("AppendCommit: %v", err)
+	}
+	pending, err = w.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("after AppendCommit, Pending = %+v, want empty", pending)
+	}
+}
+
+// TestWALPendingPrepareWithoutCommitDecision checks the other branch
+// replayWAL must distinguish: a uuid that crashed during PREPARE, before
+// Commit ever ran, still has Commit == nil and must be rolled back in
+// full rather than redone.
+func TestWALPendingPrepareWithoutCommitDecision(t *testing.T) {
+	w := NewMemoryWAL()
+	queries := []*InsertQuery{{}, {}}
+	if err := w.AppendPrepare(7, queries, []int{0, 1}); err != nil {
+		t.Fatalf("AppendPrepare: %v", err)
+	}
+
+	pending, err := w.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Commit != nil {
+		t.Fatalf("Pending = %+v, want one record with Commit == nil", pending)
+	}
+}
+
+// TestFileWALSurvivesRestart appends more than one record, closes the
+// WAL, and reopens it against the same path: every record past the
+// first must still decode. A single gob.Encoder opened fresh per append
+// (the bug this guards against) re-sends gob's type info into the
+// middle of the file, which a decoder reading the whole file back in
+// one continuous stream rejects as "duplicate type received" --
+// silently losing everything after the first record.
+func TestFileWALSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.dat")
+
+	w, err := NewFileWAL(path, PerRecordFsync)
+	if err != nil {
+		t.Fatalf("NewFileWAL: %v", err)
+	}
+	if err := w.AppendPrepare(1, []*InsertQuery{{}}, []int{0}); err != nil {
+		t.Fatalf("AppendPrepare(1): %v", err)
+	}
+	if err := w.AppendPrepare(2, []*InsertQuery{{}, {}}, []int{1, 2}); err != nil {
+		t.Fatalf("AppendPrepare(2): %v", err)
+	}
+	if err := w.AppendCommitDecision(1, []bool{true}); err != nil {
+		t.Fatalf("AppendCommitDecision(1): %v", err)
+	}
+	if err := w.file.Close(); err != nil {
+		t.Fatalf("closing WAL file: %v", err)
+	}
+
+	reopened, err := NewFileWAL(path, PerRecordFsync)
+	if err != nil {
+		t.Fatalf("NewFileWAL on reopen: %v", err)
+	}
+	pending, err := reopened.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("Pending after restart = %+v, want 2 records (uuids 1 and 2)", pending)
+	}
+
+	byUuid := map[int64]WALRecord{}
+	for _, rec := range pending {
+		byUuid[rec.Uuid] = rec
+	}
+	if rec, ok := byUuid[1]; !ok || rec.Kind != WALCommitDecided || len(rec.Commit) != 1 {
+		t.Errorf("uuid 1 after restart = %+v, want WALCommitDecided with Commit == [true]", rec)
+	}
+	if rec, ok := byUuid[2]; !ok || rec.Kind != WALPrepare || len(rec.Queries) != 2 {
+		t.Errorf("uuid 2 after restart = %+v, want WALPrepare with 2 Queries", rec)
+	}
+}